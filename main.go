@@ -1,21 +1,43 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"log/slog"
 	"os"
-	"strconv"
 	"time"
 
-	"github.com/lib/pq"
+	"github.com/jsegura/sampleworkqueue/queue"
 	_ "github.com/lib/pq"
 )
 
 var flagMode string
 var connStr = "user=postgres dbname=postgres sslmode=disable port=9932 host=127.0.0.1 password=postgres"
 
+// workerID identifies this process when claiming tasks and heartbeating.
+var workerID = fmt.Sprintf("worker-%d", os.Getpid())
+
+const (
+	heartbeatInterval = 5 * time.Second
+	staleWorkerTTL    = 30 * time.Second
+	reapInterval      = 10 * time.Second
+
+	// fallbackPollInterval is the longest we'll ever wait between
+	// catchup passes, as a safety net against missed notifications.
+	fallbackPollInterval = 10 * time.Second
+)
+
+// notifyPayload is the JSON body sent by the tasks_after_insert_trigger,
+// letting the listener know when the new task is actually due to run.
+type notifyPayload struct {
+	ID    int64     `json:"id"`
+	RunAt time.Time `json:"run_at"`
+}
+
 func main() {
 
 	flag.StringVar(&flagMode, "mode", "consumer", "Mode to run in: consumer or publisher")
@@ -27,163 +49,190 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Create our queue table that holds the tasks
-	// To simplify, the payload is just a string
-	slog.Info("creating tasks table if needed")
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS tasks (
-		id SERIAL PRIMARY KEY,
-		name TEXT NOT NULL,
-		payload TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		executed_at TIMESTAMP
-	)`)
-	if err != nil {
-		slog.Error("error creating tasks table", "error", err)
-		os.Exit(1)
-	}
+	q := queue.New(db, queue.Config{MaxAttempts: queue.DefaultMaxAttempts})
 
-	// creating the trigger
-	slog.Info("creating trigger if needed")
-	_, err = db.Exec(`CREATE OR REPLACE FUNCTION tasks_after_insert_trigger()
-RETURNS TRIGGER AS $$
-BEGIN
-  PERFORM pg_notify('tasks_inserted', NEW.id::text);
-  RETURN NULL;
-END;
-$$
-LANGUAGE plpgsql;
-
-DO
-$$BEGIN
-	CREATE TRIGGER tasks_after_insert_trigger
-	AFTER INSERT ON tasks
-	FOR EACH ROW EXECUTE PROCEDURE tasks_after_insert_trigger();
-EXCEPTION
-   WHEN duplicate_object THEN
-      NULL;
-END;$$;
-`)
-	if err != nil {
-		slog.Error("error creating trigger", "error", err)
+	slog.Info("ensuring tasks schema")
+	if err := q.EnsureSchema(context.Background()); err != nil {
+		slog.Error("error ensuring tasks schema", "error", err)
 		os.Exit(1)
 	}
 
+	registry := queue.NewRegistry()
+	registry.Register("task", queue.HandlerFunc(func(_ context.Context, job queue.Job) error {
+		slog.Info("executing task", "taskID", job.ID, "taskName", job.Name, "taskPayload", string(job.Payload))
+		return nil
+	}))
+
 	if flagMode == "consumer" {
-		consumer(db)
+		consumer(q, registry)
 	} else if flagMode == "publisher" {
-		publisher(db)
+		publisher(q)
 	} else {
 		slog.Error("invalid mode", "mode", flagMode)
 		os.Exit(1)
 	}
 }
 
-func consumer(db *sql.DB) {
+// notifier is the subset of *queue.Notifier that consumer depends on, so
+// tests can drive the consumer loop with a fake instead of a real
+// Postgres LISTEN/NOTIFY connection.
+type notifier interface {
+	Subscribe(channel string) (<-chan queue.Notification, func())
+	Run(ctx context.Context)
+	Close() error
+}
+
+func consumer(q *queue.Queue, registry *queue.Registry) {
 	slog.Info("running in consumer mode")
 
-	catchup(db)
+	ctx := context.Background()
 
-	listener := pq.NewListener(connStr, 1*time.Second, time.Minute, nil)
-	if err := listener.Listen("tasks_inserted"); err != nil {
-		log.Fatalf("Failed to listen on channel 'new_task': %v", err)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = workerID
+	}
+	if err := q.StartHealthUpdate(ctx, workerID, hostname, heartbeatInterval); err != nil {
+		slog.Error("error starting health updates", "error", err)
+		os.Exit(1)
 	}
+	q.StartReaper(ctx, staleWorkerTTL, reapInterval)
+
+	catchup(ctx, q, registry)
+
+	n := queue.NewNotifier(connStr, 1*time.Second, time.Minute, func(_ context.Context) {
+		slog.Info("listener reconnected, running a catchup pass to recover any lost notifications")
+		catchup(ctx, q, registry)
+	})
+	runConsumer(ctx, q, registry, n)
+}
+
+// runConsumer drives the notify/poll loop against an injected notifier, so
+// tests can substitute a fake in place of a real Postgres connection.
+func runConsumer(ctx context.Context, q *queue.Queue, registry *queue.Registry, n notifier) {
+	defer n.Close()
+	go n.Run(ctx)
+
+	notifications, unsubscribe := n.Subscribe("tasks_inserted")
+	defer unsubscribe()
 	slog.Info("Listening for notifications on channel 'tasks_inserted'...")
 
-	slog.Info("at the same time, doing a catchup every 10 seconds")
+	slog.Info("scheduling catchups around the next due run_at, falling back to a periodic poll")
+
+	timer := time.NewTimer(fallbackPollInterval)
+	defer timer.Stop()
+	scheduleNextWakeup(ctx, q, timer)
 
-	ticker := time.NewTicker(10 * time.Second)
 	for {
 		select {
-		case notification := <-listener.Notify:
-			if notification == nil {
-				// This can happen if the listener is closed or an error occurs
+		case <-ctx.Done():
+			return
+		case notification, ok := <-notifications:
+			if !ok {
 				continue
 			}
-			log.Printf("Received NOTIFY on channel '%s': new task id = %s\n",
-				notification.Channel, notification.Extra)
+			log.Printf("Received NOTIFY on channel '%s': %s\n",
+				notification.Channel, notification.Payload)
 
-			id, err := strconv.Atoi(notification.Extra)
-			if err != nil {
-				slog.Error("error parsing task id", "error", err)
+			var payload notifyPayload
+			if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+				slog.Error("error parsing notification payload", "error", err)
+				catchup(ctx, q, registry)
 				continue
 			}
-			doJob(db, id)
-		case <-ticker.C:
-			catchup(db)
+			if !payload.RunAt.After(time.Now()) {
+				catchup(ctx, q, registry)
+			} else {
+				// Don't just schedule around this notification's own
+				// run_at: some earlier wakeup may already be due sooner,
+				// so recompute the minimum across every ready task.
+				scheduleNextWakeup(ctx, q, timer)
+			}
+		case <-timer.C:
+			catchup(ctx, q, registry)
+			scheduleNextWakeup(ctx, q, timer)
+		}
+
+	}
+}
+
+// scheduleNextWakeup resets timer to fire when the next ready task is due,
+// falling back to fallbackPollInterval if none is scheduled sooner.
+func scheduleNextWakeup(ctx context.Context, q *queue.Queue, timer *time.Timer) {
+	wait := fallbackPollInterval
+	runAt, ok, err := q.NextRunAt(ctx)
+	if err != nil {
+		slog.Error("error computing next wakeup", "error", err)
+	} else if ok {
+		if d := time.Until(runAt); d < wait {
+			wait = d
 		}
+	}
+	resetTimer(timer, wait)
+}
 
+// resetTimer stops and drains timer before rescheduling it for d, which
+// may be negative if the next run_at has already passed.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if d < 0 {
+		d = 0
 	}
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
 }
 
-func catchup(db *sql.DB) {
-	// Process the pending tasks
-	var taskID int
+// catchup drains every ready task, claiming and dispatching it.
+func catchup(ctx context.Context, q *queue.Queue, registry *queue.Registry) {
 	slog.Info("catching up on pending tasks")
 
 	for {
-		err := db.QueryRow(`
-		SELECT id
-	  FROM tasks
-	 WHERE executed_at IS NULL
-	   FOR UPDATE SKIP LOCKED
-	 LIMIT 1
-		`).Scan(&taskID)
+		jobs, err := q.Dequeue(ctx, workerID, 1)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				slog.Info("no tasks")
-				return
-			} else {
-				slog.Error("error getting task", "error", err)
-				return
-			}
-		} else {
-			slog.Info("got task", "taskID", taskID)
-			doJob(db, taskID)
+			slog.Error("error dequeuing task", "error", err)
+			return
+		}
+		if len(jobs) == 0 {
+			slog.Info("no tasks")
+			return
+		}
+		for _, job := range jobs {
+			doJob(ctx, q, registry, job)
 		}
 	}
 }
 
-func doJob(db *sql.DB, taskID int) {
-
-	var taskName string
-	var taskPayload string
-
-	err := db.QueryRow(`SELECT name, payload FROM tasks WHERE id = $1`, taskID).Scan(&taskName, &taskPayload)
-	if err != nil {
-		slog.Error("error getting task", "error", err)
+func doJob(ctx context.Context, q *queue.Queue, registry *queue.Registry, job queue.Job) {
+	if err := registry.Dispatch(ctx, job); err != nil {
+		slog.Error("error handling task", "taskID", job.ID, "taskName", job.Name, "error", err)
+		state, failErr := q.Fail(ctx, job.ID, err)
+		if failErr != nil {
+			slog.Error("error failing task", "taskID", job.ID, "error", failErr)
+			return
+		}
+		slog.Info("task requeued after failure", "taskID", job.ID, "nextState", state)
 		return
 	}
-	slog.Info("executing task", "taskID", taskID, "taskName", taskName, "taskPayload", taskPayload)
-	// Execute the task
-	_, err = db.Exec(`UPDATE tasks SET executed_at = CURRENT_TIMESTAMP WHERE id = $1`, taskID)
-	if err != nil {
-		slog.Error("error executing task", "error", err)
+	if _, err := q.Acknowledge(ctx, queue.StateCompleted, []int64{job.ID}); err != nil {
+		slog.Error("error acknowledging task", "taskID", job.ID, "error", err)
 	}
 }
 
-func publisher(db *sql.DB) {
+func publisher(q *queue.Queue) {
 	slog.Info("running in publisher mode. Publishing a task per second")
 
+	ctx := context.Background()
 	ticker := time.NewTicker(time.Second)
 	for range ticker.C {
-		var id int
-		err := db.QueryRow(`INSERT INTO tasks (name, payload) VALUES ($1, $2) RETURNING id`, "task", "payload").Scan(&id)
+		id, err := q.Enqueue(ctx, "task", []byte("payload"))
 		if err != nil {
 			slog.Error("error inserting task", "error", err)
+			continue
 		}
 
 		slog.Info("published task", "taskID", id)
-
-		// publishing the task
-
-	}
-}
-
-func doTask(db *sql.DB, taskID int) {
-	slog.Info("executing task", "taskID", taskID)
-	// Execute the task
-	_, err := db.Exec(`UPDATE tasks SET executed_at = CURRENT_TIMESTAMP WHERE id = $1`, taskID)
-	if err != nil {
-		slog.Error("error executing task", "error", err)
 	}
 }
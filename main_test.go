@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jsegura/sampleworkqueue/queue"
+	_ "github.com/lib/pq"
+)
+
+// fakeNotifier lets tests drive runConsumer's notify path without a real
+// Postgres LISTEN/NOTIFY connection.
+type fakeNotifier struct {
+	notifications chan queue.Notification
+}
+
+func (f *fakeNotifier) Subscribe(string) (<-chan queue.Notification, func()) {
+	return f.notifications, func() {}
+}
+func (f *fakeNotifier) Run(context.Context) {}
+func (f *fakeNotifier) Close() error        { return nil }
+
+// newConsumerTestQueue returns a Queue against a scratch schema, skipping
+// the test if no Postgres instance is reachable.
+func newConsumerTestQueue(t *testing.T) *queue.Queue {
+	t.Helper()
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Skipf("skipping: opening test database: %v", err)
+	}
+	if err := db.PingContext(context.Background()); err != nil {
+		t.Skipf("skipping: no test database reachable at %s: %v", connStr, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	q := queue.New(db, queue.Config{})
+	if err := q.EnsureSchema(context.Background()); err != nil {
+		t.Fatalf("ensuring schema: %v", err)
+	}
+	if _, err := db.Exec(`TRUNCATE tasks, workers`); err != nil {
+		t.Fatalf("truncating tables: %v", err)
+	}
+	return q
+}
+
+func TestRunConsumerDispatchesOnNotify(t *testing.T) {
+	q := newConsumerTestQueue(t)
+
+	registry := queue.NewRegistry()
+	handled := make(chan int64, 1)
+	registry.Register("task", queue.HandlerFunc(func(_ context.Context, job queue.Job) error {
+		handled <- job.ID
+		return nil
+	}))
+
+	id, err := q.Enqueue(context.Background(), "task", []byte("x"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	n := &fakeNotifier{notifications: make(chan queue.Notification, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go runConsumer(ctx, q, registry, n)
+
+	payload, err := json.Marshal(notifyPayload{ID: id, RunAt: time.Now()})
+	if err != nil {
+		t.Fatalf("marshaling payload: %v", err)
+	}
+	n.notifications <- queue.Notification{Channel: "tasks_inserted", Payload: string(payload)}
+
+	select {
+	case got := <-handled:
+		if got != id {
+			t.Fatalf("handler ran for task %d, want %d", got, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler was not invoked after notify")
+	}
+}
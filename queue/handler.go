@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Handler processes a single claimed task.
+type Handler interface {
+	Handle(ctx context.Context, job Job) error
+}
+
+// HandlerFunc adapts a plain function into a Handler.
+type HandlerFunc func(ctx context.Context, job Job) error
+
+// Handle calls f.
+func (f HandlerFunc) Handle(ctx context.Context, job Job) error {
+	return f(ctx, job)
+}
+
+// Registry dispatches claimed jobs to a Handler registered by task name.
+type Registry struct {
+	handlers map[string]Handler
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+// Register associates name with handler. Later calls to Dispatch for jobs
+// named name invoke it.
+func (r *Registry) Register(name string, handler Handler) {
+	r.handlers[name] = handler
+}
+
+// Dispatch looks up the handler registered for job.Name and invokes it. It
+// returns an error if no handler is registered for that name.
+func (r *Registry) Dispatch(ctx context.Context, job Job) error {
+	handler, ok := r.handlers[job.Name]
+	if !ok {
+		return fmt.Errorf("queue: no handler registered for %q", job.Name)
+	}
+	return handler.Handle(ctx, job)
+}
+
+// TypedHandler adapts a function over a JSON-decoded payload into a
+// Handler, so callers don't have to unmarshal job.Payload by hand.
+type TypedHandler[T any] func(ctx context.Context, job Job, payload T) error
+
+// Handle unmarshals job.Payload as JSON into T and calls h.
+func (h TypedHandler[T]) Handle(ctx context.Context, job Job) error {
+	var payload T
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("queue: unmarshaling payload for %q: %w", job.Name, err)
+	}
+	return h(ctx, job, payload)
+}
+
+// EnqueueJSON marshals v to JSON and enqueues it under name.
+func EnqueueJSON[T any](ctx context.Context, q *Queue, name string, v T, opts ...EnqueueOption) (int64, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("queue: marshaling payload for %q: %w", name, err)
+	}
+	return q.Enqueue(ctx, name, payload, opts...)
+}
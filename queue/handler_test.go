@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRegistryDispatch(t *testing.T) {
+	r := NewRegistry()
+
+	var handled Job
+	r.Register("send_email", HandlerFunc(func(_ context.Context, job Job) error {
+		handled = job
+		return nil
+	}))
+
+	job := Job{ID: 1, Name: "send_email", Payload: []byte("hi")}
+	if err := r.Dispatch(context.Background(), job); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if handled.ID != job.ID || handled.Name != job.Name || string(handled.Payload) != string(job.Payload) {
+		t.Fatalf("dispatch: handler saw %+v, want %+v", handled, job)
+	}
+
+	if err := r.Dispatch(context.Background(), Job{Name: "unregistered"}); err == nil {
+		t.Fatalf("dispatch: want an error for an unregistered task name")
+	}
+}
+
+func TestTypedHandlerUnmarshalsPayload(t *testing.T) {
+	type emailPayload struct {
+		To string `json:"to"`
+	}
+
+	var got emailPayload
+	h := TypedHandler[emailPayload](func(_ context.Context, _ Job, payload emailPayload) error {
+		got = payload
+		return nil
+	})
+
+	payload, err := json.Marshal(emailPayload{To: "a@example.com"})
+	if err != nil {
+		t.Fatalf("marshaling payload: %v", err)
+	}
+
+	if err := h.Handle(context.Background(), Job{Payload: payload}); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if got.To != "a@example.com" {
+		t.Fatalf("handle: got %+v, want To %q", got, "a@example.com")
+	}
+
+	if err := h.Handle(context.Background(), Job{Payload: []byte("not json")}); err == nil {
+		t.Fatalf("handle: want an error unmarshaling invalid JSON")
+	}
+}
+
+func TestTypedHandlerPropagatesHandlerError(t *testing.T) {
+	wantErr := errors.New("boom")
+	h := TypedHandler[struct{}](func(_ context.Context, _ Job, _ struct{}) error {
+		return wantErr
+	})
+
+	if err := h.Handle(context.Background(), Job{Payload: []byte("{}")}); err != wantErr {
+		t.Fatalf("handle: got %v, want %v", err, wantErr)
+	}
+}
@@ -0,0 +1,149 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notification is a single pub/sub event delivered on a channel the
+// Notifier is listening on.
+type Notification struct {
+	Channel string
+	Payload string
+}
+
+// Notifier owns a single pq.Listener connection and multiplexes its
+// notifications to any number of Go-side subscribers, so metrics,
+// tracing, a webhook forwarder, and a worker loop can each react to the
+// same Postgres NOTIFY independently.
+type Notifier struct {
+	// listener is nil in the zero value, which dispatch/Subscribe/Close
+	// tolerate so tests can exercise the fan-out logic without a real
+	// Postgres connection.
+	listener *pq.Listener
+
+	mu   sync.Mutex
+	subs map[string][]chan Notification
+
+	onReconnect func(ctx context.Context)
+}
+
+// NewNotifier creates a Notifier backed by a new pq.Listener against
+// connStr. onReconnect, if non-nil, is called after every reconnection so
+// callers can run a catchup pass and recover notifications that may have
+// been silently lost during the outage window.
+func NewNotifier(connStr string, minReconnect, maxReconnect time.Duration, onReconnect func(ctx context.Context)) *Notifier {
+	n := &Notifier{
+		subs:        make(map[string][]chan Notification),
+		onReconnect: onReconnect,
+	}
+	n.listener = pq.NewListener(connStr, minReconnect, maxReconnect, n.handleEvent)
+	return n
+}
+
+func (n *Notifier) handleEvent(ev pq.ListenerEventType, err error) {
+	if err != nil {
+		slog.Error("queue: listener event error", "error", err)
+	}
+	if ev == pq.ListenerEventReconnected && n.onReconnect != nil {
+		n.onReconnect(context.Background())
+	}
+}
+
+// Subscribe starts delivering notifications on channel to the returned
+// channel, issuing a LISTEN the first time channel gains a subscriber.
+// Callers must call the returned cancel once done to unsubscribe; cancel
+// closes the channel and, once channel has no more subscribers, UNLISTENs
+// it.
+func (n *Notifier) Subscribe(channel string) (<-chan Notification, func()) {
+	n.mu.Lock()
+	first := len(n.subs[channel]) == 0
+	ch := make(chan Notification, 16)
+	n.subs[channel] = append(n.subs[channel], ch)
+	n.mu.Unlock()
+
+	if first && n.listener != nil {
+		if err := n.listener.Listen(channel); err != nil {
+			slog.Error("queue: listen failed", "channel", channel, "error", err)
+		}
+	}
+
+	cancel := func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.subs[channel] = removeChan(n.subs[channel], ch)
+		close(ch)
+		if len(n.subs[channel]) == 0 {
+			delete(n.subs, channel)
+			if n.listener != nil {
+				if err := n.listener.Unlisten(channel); err != nil {
+					slog.Error("queue: unlisten failed", "channel", channel, "error", err)
+				}
+			}
+		}
+	}
+	return ch, cancel
+}
+
+func removeChan(chans []chan Notification, target chan Notification) []chan Notification {
+	out := chans[:0]
+	for _, c := range chans {
+		if c != target {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Run reads incoming listener notifications and fans each one out to its
+// channel's subscribers until ctx is canceled. On a listener-less Notifier
+// there are no notifications to read, so it just blocks until ctx is
+// canceled instead.
+func (n *Notifier) Run(ctx context.Context) {
+	if n.listener == nil {
+		<-ctx.Done()
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-n.listener.Notify:
+			if notification == nil {
+				// Can happen if the listener drops its connection.
+				continue
+			}
+			n.dispatch(Notification{Channel: notification.Channel, Payload: notification.Extra})
+		}
+	}
+}
+
+func (n *Notifier) dispatch(note Notification) {
+	n.mu.Lock()
+	subs := append([]chan Notification(nil), n.subs[note.Channel]...)
+	n.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- note:
+		default:
+			slog.Error("queue: subscriber channel full, dropping notification", "channel", note.Channel)
+		}
+	}
+}
+
+// Close stops the underlying listener connection.
+func (n *Notifier) Close() error {
+	if n.listener == nil {
+		return nil
+	}
+	if err := n.listener.Close(); err != nil {
+		return fmt.Errorf("queue: closing notifier: %w", err)
+	}
+	return nil
+}
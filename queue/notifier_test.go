@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestNotifier returns a Notifier with no backing pq.Listener, so its
+// fan-out logic can be exercised without a real Postgres connection.
+func newTestNotifier() *Notifier {
+	return &Notifier{subs: make(map[string][]chan Notification)}
+}
+
+func TestNotifierDispatchFansOutToSubscribers(t *testing.T) {
+	n := newTestNotifier()
+
+	chA, cancelA := n.Subscribe("tasks_inserted")
+	defer cancelA()
+	chB, cancelB := n.Subscribe("tasks_inserted")
+	defer cancelB()
+	other, cancelOther := n.Subscribe("other_channel")
+	defer cancelOther()
+
+	n.dispatch(Notification{Channel: "tasks_inserted", Payload: "hi"})
+
+	for name, ch := range map[string]<-chan Notification{"A": chA, "B": chB} {
+		select {
+		case note := <-ch:
+			if note.Payload != "hi" {
+				t.Fatalf("subscriber %s: got payload %q, want %q", name, note.Payload, "hi")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %s: did not receive dispatched notification", name)
+		}
+	}
+
+	select {
+	case note := <-other:
+		t.Fatalf("subscriber on other_channel: got unexpected notification %+v", note)
+	default:
+	}
+}
+
+func TestNotifierUnsubscribeClosesChannel(t *testing.T) {
+	n := newTestNotifier()
+
+	ch, cancel := n.Subscribe("tasks_inserted")
+	cancel()
+
+	if _, ok := <-ch; ok {
+		t.Fatalf("subscriber channel: want closed after cancel, got a value")
+	}
+
+	// Dispatching after every subscriber has unsubscribed should be a
+	// no-op, not a panic from sending on a closed channel.
+	n.dispatch(Notification{Channel: "tasks_inserted", Payload: "hi"})
+}
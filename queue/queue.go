@@ -0,0 +1,482 @@
+// Package queue implements a small Postgres-backed job queue on top of a
+// single `tasks` table. It separates the transport concerns (enqueuing,
+// claiming, and acknowledging work) from the trigger/listener wiring that
+// notifies consumers a new task is available.
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// JobState is the lifecycle state of a row in the tasks table.
+type JobState string
+
+const (
+	// StateReady marks a task that is waiting to be claimed.
+	StateReady JobState = "ready"
+	// StateInProgress marks a task that has been claimed by a worker.
+	StateInProgress JobState = "in_progress"
+	// StateCompleted marks a task that finished successfully.
+	StateCompleted JobState = "completed"
+	// StateFailed marks a task whose handler returned an error. Fail
+	// moves a task through this state on its way to either being
+	// requeued as ready or, past MaxAttempts, marked dead.
+	StateFailed JobState = "failed"
+	// StateDead marks a task that will no longer be redelivered.
+	StateDead JobState = "dead"
+)
+
+// Job is a single row claimed from the tasks table.
+type Job struct {
+	ID        int64
+	Name      string
+	Payload   []byte
+	State     JobState
+	Priority  int16
+	RunAt     time.Time
+	CreatedAt time.Time
+}
+
+// DefaultMaxAttempts is used when Config.MaxAttempts is left unset.
+const DefaultMaxAttempts = 5
+
+// DefaultBackoffBase is used when Config.BackoffBase is left unset.
+const DefaultBackoffBase = time.Second
+
+// DefaultSchedulerConfig weights explicit priority first, with a mild age
+// boost so older tasks eventually rise above newer ones of equal
+// priority, and a fairness penalty so one busy name can't starve others.
+var DefaultSchedulerConfig = SchedulerConfig{
+	PriorityWeight: 1,
+	AgeWeight:      1,
+	FairnessWeight: 1,
+}
+
+// SchedulerConfig tunes how Dequeue orders ready tasks. Each ready task's
+// score is:
+//
+//	priority*PriorityWeight + age_bonus*AgeWeight - inflight_penalty*FairnessWeight
+//
+// where age_bonus is the number of hours the task has been waiting and
+// inflight_penalty is the number of tasks of the same name currently
+// in_progress.
+type SchedulerConfig struct {
+	PriorityWeight float64
+	AgeWeight      float64
+	FairnessWeight float64
+}
+
+// Config tunes queue behavior.
+type Config struct {
+	// MaxAttempts is how many times a task may be redelivered, whether
+	// from a Reap or a failed Handler, before it is marked dead. Zero
+	// uses DefaultMaxAttempts.
+	MaxAttempts int
+
+	// BackoffBase is the base delay for Fail's exponential backoff:
+	// run_at = now + BackoffBase*2^attempts. Zero uses DefaultBackoffBase.
+	BackoffBase time.Duration
+
+	// Clock returns the current time. Tests may override it to control
+	// scheduling without sleeping. Nil uses time.Now.
+	Clock func() time.Time
+
+	// Scheduler tunes priority, age, and fairness weighting in Dequeue.
+	// The zero value uses DefaultSchedulerConfig.
+	Scheduler SchedulerConfig
+}
+
+// Queue wraps a *sql.DB and implements the enqueue/dequeue/acknowledge
+// lifecycle for the tasks table.
+type Queue struct {
+	db  *sql.DB
+	cfg Config
+}
+
+// New returns a Queue backed by db. Callers must call EnsureSchema once
+// before using it.
+func New(db *sql.DB, cfg Config) *Queue {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.BackoffBase <= 0 {
+		cfg.BackoffBase = DefaultBackoffBase
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	if cfg.Scheduler == (SchedulerConfig{}) {
+		cfg.Scheduler = DefaultSchedulerConfig
+	}
+	return &Queue{db: db, cfg: cfg}
+}
+
+// now returns the queue's current time, routed through cfg.Clock so it is
+// the same timestamp Postgres sees for run_at comparisons and tests can
+// inject their own clock.
+func (q *Queue) now() time.Time {
+	return q.cfg.Clock()
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS workers (
+	id TEXT PRIMARY KEY,
+	hostname TEXT NOT NULL,
+	last_seen TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	payload BYTEA,
+	state TEXT NOT NULL DEFAULT 'ready',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	executed_at TIMESTAMP
+);
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS worker_id TEXT REFERENCES workers(id);
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS run_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE tasks ALTER COLUMN payload TYPE BYTEA USING payload::BYTEA;
+
+CREATE OR REPLACE FUNCTION tasks_after_insert_trigger()
+RETURNS TRIGGER AS $$
+BEGIN
+  PERFORM pg_notify('tasks_inserted', json_build_object('id', NEW.id, 'run_at', NEW.run_at)::text);
+  RETURN NULL;
+END;
+$$
+LANGUAGE plpgsql;
+
+DO
+$$BEGIN
+	CREATE TRIGGER tasks_after_insert_trigger
+	AFTER INSERT ON tasks
+	FOR EACH ROW EXECUTE PROCEDURE tasks_after_insert_trigger();
+EXCEPTION
+   WHEN duplicate_object THEN
+      NULL;
+END;$$;
+`
+
+// EnsureSchema creates the tasks table, and its supporting notify trigger,
+// if they do not already exist.
+func (q *Queue) EnsureSchema(ctx context.Context) error {
+	if _, err := q.db.ExecContext(ctx, schema); err != nil {
+		return fmt.Errorf("queue: ensuring schema: %w", err)
+	}
+	return nil
+}
+
+// enqueueOptions holds the settings an EnqueueOption can customize.
+type enqueueOptions struct {
+	priority int16
+}
+
+// EnqueueOption customizes a single Enqueue/EnqueueAt/EnqueueIn call.
+type EnqueueOption func(*enqueueOptions)
+
+// WithPriority sets the priority of the enqueued task. Higher priorities
+// are dequeued first; the default is 0.
+func WithPriority(priority int16) EnqueueOption {
+	return func(o *enqueueOptions) { o.priority = priority }
+}
+
+// Enqueue inserts a new task in the ready state, scheduled to run
+// immediately, and returns its id.
+func (q *Queue) Enqueue(ctx context.Context, name string, payload []byte, opts ...EnqueueOption) (int64, error) {
+	return q.EnqueueAt(ctx, name, payload, q.now(), opts...)
+}
+
+// EnqueueAt inserts a new ready task scheduled to run at runAt.
+func (q *Queue) EnqueueAt(ctx context.Context, name string, payload []byte, runAt time.Time, opts ...EnqueueOption) (int64, error) {
+	var o enqueueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var id int64
+	err := q.db.QueryRowContext(ctx,
+		`INSERT INTO tasks (name, payload, state, run_at, priority) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		name, payload, StateReady, runAt, o.priority,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("queue: enqueue %q: %w", name, err)
+	}
+	return id, nil
+}
+
+// EnqueueIn inserts a new ready task scheduled to run after delay elapses.
+func (q *Queue) EnqueueIn(ctx context.Context, name string, payload []byte, delay time.Duration, opts ...EnqueueOption) (int64, error) {
+	return q.EnqueueAt(ctx, name, payload, q.now().Add(delay), opts...)
+}
+
+// Dequeue atomically claims up to n ready tasks for workerID whose run_at
+// has come due, transitioning them from ready to in_progress, and returns
+// the claimed jobs. Selection is weighted by cfg.Scheduler across
+// priority, age, and per-name fairness, rather than plain FIFO.
+func (q *Queue) Dequeue(ctx context.Context, workerID string, n int) ([]Job, error) {
+	sched := q.cfg.Scheduler
+	now := q.now()
+
+	rows, err := q.db.QueryContext(ctx, `
+		UPDATE tasks
+		   SET state = $1, worker_id = $8
+		 WHERE id IN (
+			WITH inflight AS (
+				SELECT name, count(*) AS n
+				  FROM tasks
+				 WHERE state = $1
+				 GROUP BY name
+			)
+			SELECT t.id
+			  FROM tasks t
+			  LEFT JOIN inflight i ON i.name = t.name
+			 WHERE t.state = $2
+			   AND t.run_at <= $3
+			 ORDER BY (
+				t.priority * $4
+				+ (extract(epoch FROM $3::timestamptz - t.created_at) / 3600.0) * $5
+				- coalesce(i.n, 0) * $6
+			 ) DESC, t.id ASC
+			   FOR UPDATE OF t SKIP LOCKED
+			 LIMIT $7
+		 )
+		RETURNING id, name, payload, state, priority, run_at, created_at
+	`, StateInProgress, StateReady, now, sched.PriorityWeight, sched.AgeWeight, sched.FairnessWeight, n, workerID)
+	if err != nil {
+		return nil, fmt.Errorf("queue: dequeue: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.ID, &j.Name, &j.Payload, &j.State, &j.Priority, &j.RunAt, &j.CreatedAt); err != nil {
+			return nil, fmt.Errorf("queue: dequeue: scanning row: %w", err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queue: dequeue: %w", err)
+	}
+	return jobs, nil
+}
+
+// NextRunAt returns the earliest run_at among ready tasks, if any exist, so
+// callers can schedule a timer for the next unit of work instead of
+// polling unconditionally.
+func (q *Queue) NextRunAt(ctx context.Context) (time.Time, bool, error) {
+	var runAt sql.NullTime
+	err := q.db.QueryRowContext(ctx,
+		`SELECT min(run_at) FROM tasks WHERE state = $1`, StateReady,
+	).Scan(&runAt)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("queue: next run at: %w", err)
+	}
+	if !runAt.Valid {
+		return time.Time{}, false, nil
+	}
+	return runAt.Time, true, nil
+}
+
+// Acknowledge transitions ids to state, but only those currently
+// in_progress, and returns the subset of ids that actually transitioned so
+// callers can tell which acks were valid.
+func (q *Queue) Acknowledge(ctx context.Context, state JobState, ids []int64) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		UPDATE tasks
+		   SET state = $1, executed_at = CURRENT_TIMESTAMP
+		 WHERE id = ANY($2)
+		   AND state = $3
+		RETURNING id
+	`, state, pq.Array(ids), StateInProgress)
+	if err != nil {
+		return nil, fmt.Errorf("queue: acknowledge: %w", err)
+	}
+	defer rows.Close()
+
+	var acked []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("queue: acknowledge: scanning row: %w", err)
+		}
+		acked = append(acked, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queue: acknowledge: %w", err)
+	}
+	return acked, nil
+}
+
+// backoffDuration returns the exponential backoff delay before attempts'th
+// redelivery: base, 2*base, 4*base, and so on.
+func backoffDuration(base time.Duration, attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+	return base * time.Duration(uint64(1)<<uint(attempts-1))
+}
+
+// Fail acknowledges a failed attempt at id, passing it through
+// StateFailed with cause recorded as last_error, then either requeues the
+// task with exponential backoff (see backoffDuration) or, once
+// cfg.MaxAttempts is reached, marks it dead. It only affects tasks
+// currently in_progress, and reports the state the task transitioned to.
+func (q *Queue) Fail(ctx context.Context, id int64, cause error) (JobState, error) {
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("queue: fail %d: %w", id, err)
+	}
+	defer tx.Rollback()
+
+	var attempts int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE tasks
+		   SET state = $1, last_error = $2, attempts = attempts + 1, worker_id = NULL
+		 WHERE id = $3
+		   AND state = $4
+		RETURNING attempts
+	`, StateFailed, cause.Error(), id, StateInProgress).Scan(&attempts)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("queue: fail %d: not in_progress", id)
+		}
+		return "", fmt.Errorf("queue: fail %d: %w", id, err)
+	}
+
+	next := StateDead
+	runAt := q.now()
+	if attempts < q.cfg.MaxAttempts {
+		next = StateReady
+		runAt = q.now().Add(backoffDuration(q.cfg.BackoffBase, attempts))
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE tasks SET state = $1, run_at = $2 WHERE id = $3 AND state = $4`,
+		next, runAt, id, StateFailed,
+	); err != nil {
+		return "", fmt.Errorf("queue: fail %d: requeuing: %w", id, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("queue: fail %d: committing: %w", id, err)
+	}
+	return next, nil
+}
+
+// RegisterWorker upserts a worker row identified by id, recording hostname
+// and the current time as its most recent heartbeat.
+func (q *Queue) RegisterWorker(ctx context.Context, id, hostname string) error {
+	_, err := q.db.ExecContext(ctx, `
+		INSERT INTO workers (id, hostname, last_seen) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET hostname = EXCLUDED.hostname, last_seen = EXCLUDED.last_seen
+	`, id, hostname, q.now())
+	if err != nil {
+		return fmt.Errorf("queue: registering worker %q: %w", id, err)
+	}
+	return nil
+}
+
+// StartHealthUpdate registers workerID and then bumps its last_seen
+// heartbeat every interval until ctx is canceled.
+func (q *Queue) StartHealthUpdate(ctx context.Context, workerID, hostname string, interval time.Duration) error {
+	if err := q.RegisterWorker(ctx, workerID, hostname); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := q.db.ExecContext(ctx, `UPDATE workers SET last_seen = $1 WHERE id = $2`, q.now(), workerID)
+				if err != nil {
+					slog.Error("queue: heartbeat failed", "workerID", workerID, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Reap recovers in_progress tasks owned by workers that have not
+// heartbeated within ttl, returning them to ready and incrementing their
+// attempts counter. Tasks that have now reached cfg.MaxAttempts are marked
+// dead instead of being retried. It returns the ids recovered to ready and
+// the ids marked dead.
+func (q *Queue) Reap(ctx context.Context, ttl time.Duration) (recovered, dead []int64, err error) {
+	now := q.now()
+	rows, err := q.db.QueryContext(ctx, `
+		UPDATE tasks
+		   SET state = CASE WHEN attempts + 1 >= $1 THEN $2 ELSE $3 END,
+		       attempts = attempts + 1,
+		       worker_id = NULL
+		 WHERE id IN (
+			SELECT t.id
+			  FROM tasks t
+			  JOIN workers w ON w.id = t.worker_id
+			 WHERE t.state = $4
+			   AND w.last_seen < $5 - ($6 * interval '1 second')
+			   FOR UPDATE OF t SKIP LOCKED
+		 )
+		RETURNING id, state
+	`, q.cfg.MaxAttempts, StateDead, StateReady, StateInProgress, now, ttl.Seconds())
+	if err != nil {
+		return nil, nil, fmt.Errorf("queue: reap: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var state JobState
+		if err := rows.Scan(&id, &state); err != nil {
+			return nil, nil, fmt.Errorf("queue: reap: scanning row: %w", err)
+		}
+		if state == StateDead {
+			dead = append(dead, id)
+		} else {
+			recovered = append(recovered, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("queue: reap: %w", err)
+	}
+	return recovered, dead, nil
+}
+
+// StartReaper runs Reap on a ticker of interval until ctx is canceled,
+// recovering in_progress tasks whose worker has gone silent for ttl.
+func (q *Queue) StartReaper(ctx context.Context, ttl, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				recovered, dead, err := q.Reap(ctx, ttl)
+				if err != nil {
+					slog.Error("queue: reap failed", "error", err)
+					continue
+				}
+				if len(recovered) > 0 || len(dead) > 0 {
+					slog.Info("queue: reaped stale tasks", "recovered", recovered, "dead", dead)
+				}
+			}
+		}
+	}()
+}
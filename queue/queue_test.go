@@ -0,0 +1,274 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// defaultTestDSN matches the connection string main.go uses against the
+// local dev Postgres; override it with SAMPLEWORKQUEUE_TEST_DSN to point
+// at a different instance.
+const defaultTestDSN = "user=postgres dbname=postgres sslmode=disable port=9932 host=127.0.0.1 password=postgres"
+
+// fakeClock lets tests advance time deterministically instead of sleeping,
+// exercising the same Config.Clock injection point production code uses.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestQueue returns a Queue against a scratch schema, skipping the test
+// if no Postgres instance is reachable.
+func newTestQueue(t *testing.T, cfg Config) *Queue {
+	t.Helper()
+
+	dsn := os.Getenv("SAMPLEWORKQUEUE_TEST_DSN")
+	if dsn == "" {
+		dsn = defaultTestDSN
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Skipf("skipping: opening test database: %v", err)
+	}
+	if err := db.PingContext(context.Background()); err != nil {
+		t.Skipf("skipping: no test database reachable at %s: %v", dsn, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	q := New(db, cfg)
+	if err := q.EnsureSchema(context.Background()); err != nil {
+		t.Fatalf("ensuring schema: %v", err)
+	}
+	if _, err := db.Exec(`TRUNCATE tasks, workers`); err != nil {
+		t.Fatalf("truncating tables: %v", err)
+	}
+	return q
+}
+
+func TestBackoffDuration(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: 0},
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+	}
+	for _, c := range cases {
+		if got := backoffDuration(time.Second, c.attempts); got != c.want {
+			t.Errorf("backoffDuration(1s, %d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestDequeueAcknowledge(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, Config{})
+
+	id, err := q.Enqueue(ctx, "send_email", []byte("hi"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	jobs, err := q.Dequeue(ctx, "worker-1", 1)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("dequeue: got %+v, want a single job with id %d", jobs, id)
+	}
+	if jobs[0].State != StateInProgress {
+		t.Fatalf("dequeue: got state %q, want %q", jobs[0].State, StateInProgress)
+	}
+
+	acked, err := q.Acknowledge(ctx, StateCompleted, []int64{id})
+	if err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	if len(acked) != 1 || acked[0] != id {
+		t.Fatalf("acknowledge: got %v, want [%d]", acked, id)
+	}
+
+	// Already completed, so a second ack is a no-op.
+	acked, err = q.Acknowledge(ctx, StateCompleted, []int64{id})
+	if err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	if len(acked) != 0 {
+		t.Fatalf("acknowledge: got %v, want no-op on an already-completed task", acked)
+	}
+}
+
+func TestFailRequeuesWithBackoffThenDies(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Now()}
+	q := newTestQueue(t, Config{MaxAttempts: 2, BackoffBase: time.Minute, Clock: clock.Now})
+
+	if err := q.RegisterWorker(ctx, "worker-1", "host-1"); err != nil {
+		t.Fatalf("registering worker: %v", err)
+	}
+
+	id, err := q.Enqueue(ctx, "flaky", []byte("x"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if _, err := q.Dequeue(ctx, "worker-1", 1); err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+
+	state, err := q.Fail(ctx, id, errors.New("boom"))
+	if err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+	if state != StateReady {
+		t.Fatalf("fail: got state %q, want %q after first failure", state, StateReady)
+	}
+
+	// Backoff hasn't elapsed yet, so it shouldn't be redelivered.
+	jobs, err := q.Dequeue(ctx, "worker-1", 1)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("dequeue: got %+v, want nothing claimable before backoff elapses", jobs)
+	}
+
+	clock.Advance(time.Minute)
+	jobs, err = q.Dequeue(ctx, "worker-1", 1)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("dequeue: got %+v, want the task back once backoff elapses", jobs)
+	}
+
+	state, err = q.Fail(ctx, id, errors.New("boom again"))
+	if err != nil {
+		t.Fatalf("fail: %v", err)
+	}
+	if state != StateDead {
+		t.Fatalf("fail: got state %q, want %q once MaxAttempts is reached", state, StateDead)
+	}
+}
+
+// taskState reads back the persisted state of id directly, so tests can
+// tell a real transition from Reap/Dequeue merely agreeing on a return
+// value that was never actually written.
+func taskState(t *testing.T, q *Queue, id int64) JobState {
+	t.Helper()
+	var state JobState
+	if err := q.db.QueryRow(`SELECT state FROM tasks WHERE id = $1`, id).Scan(&state); err != nil {
+		t.Fatalf("reading back state for %d: %v", id, err)
+	}
+	return state
+}
+
+func TestReapRecoversStaleThenKills(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Now()}
+	q := newTestQueue(t, Config{MaxAttempts: 2, Clock: clock.Now})
+
+	if err := q.RegisterWorker(ctx, "worker-1", "host-1"); err != nil {
+		t.Fatalf("registering worker: %v", err)
+	}
+
+	id, err := q.Enqueue(ctx, "job", []byte("x"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if _, err := q.Dequeue(ctx, "worker-1", 1); err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	recovered, dead, err := q.Reap(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(recovered) != 1 || recovered[0] != id || len(dead) != 0 {
+		t.Fatalf("reap: got recovered=%v dead=%v, want %d recovered", recovered, dead, id)
+	}
+	if state := taskState(t, q, id); state != StateReady {
+		t.Fatalf("reap: task %d persisted as %q, want %q", id, state, StateReady)
+	}
+
+	jobs, err := q.Dequeue(ctx, "worker-1", 1)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != id {
+		t.Fatalf("dequeue: got %+v, want the recovered task %d to be claimable again", jobs, id)
+	}
+	clock.Advance(2 * time.Minute)
+
+	recovered, dead, err = q.Reap(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(dead) != 1 || dead[0] != id || len(recovered) != 0 {
+		t.Fatalf("reap: got recovered=%v dead=%v, want %d dead once MaxAttempts is reached", recovered, dead, id)
+	}
+	if state := taskState(t, q, id); state != StateDead {
+		t.Fatalf("reap: task %d persisted as %q, want %q", id, state, StateDead)
+	}
+}
+
+func TestDequeueFairnessAcrossNames(t *testing.T) {
+	ctx := context.Background()
+	q := newTestQueue(t, Config{
+		Scheduler: SchedulerConfig{PriorityWeight: 1, AgeWeight: 0, FairnessWeight: 10},
+	})
+
+	if err := q.RegisterWorker(ctx, "worker-busy", "host-1"); err != nil {
+		t.Fatalf("registering worker: %v", err)
+	}
+
+	// Three "busy" tasks already in flight should make the scheduler
+	// penalize a fourth "busy" task relative to an equally-old "quiet" one.
+	for i := 0; i < 3; i++ {
+		if _, err := q.Enqueue(ctx, "busy", []byte("x")); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		if _, err := q.Dequeue(ctx, "worker-busy", 1); err != nil {
+			t.Fatalf("dequeue: %v", err)
+		}
+	}
+
+	busyID, err := q.Enqueue(ctx, "busy", []byte("x"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	quietID, err := q.Enqueue(ctx, "quiet", []byte("x"))
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	jobs, err := q.Dequeue(ctx, "worker-1", 1)
+	if err != nil {
+		t.Fatalf("dequeue: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != quietID {
+		t.Fatalf("dequeue: got %+v, want the uncontended quiet task %d over busy task %d", jobs, quietID, busyID)
+	}
+}